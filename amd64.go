@@ -0,0 +1,359 @@
+package jit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// amd64 register allocation window: xmm0/xmm1 are scratch for the current
+// operation, xmm2..xmm7 are available to the linear-scan allocator.
+const (
+	amd64RegBase = 2
+	amd64NumRegs = 6
+)
+
+// amd64Arch is the arch backend for GOARCH=="amd64". It emits SSE2 scalar
+// double-precision code, keeping its parameters (and any spilled SSA
+// values) on the stack frame.
+type amd64Arch struct{}
+
+func (amd64Arch) compile(root expr, params []string, hasCall map[expr]bool, callDepth map[expr]int) ([]byte, compileStats) {
+	instrs, rootVal := lower(root)
+	alloc := linearScan(instrs, amd64RegBase, amd64NumRegs)
+
+	paramOffset := make(map[string]int, len(params))
+	for i, p := range params {
+		paramOffset[p] = -8 * (i + 1)
+	}
+
+	frameSize := 8*len(params) + 8*numSpillSlots(alloc)
+	if frameSize%16 != 0 {
+		frameSize += 8 // keep the frame 16-byte aligned
+	}
+
+	b := buf{params: paramOffset, numParams: len(params)}
+	b.emit(push_rbp, mov_rsp_rbp) // function preamble
+	b.emit(sub_rsp(frameSize))    // stack space for params and spills
+	for i, p := range params {
+		off := paramOffset[p]
+		if i < 8 {
+			b.emit(mov_xmm_x_rbp(i, off)) // xmmN (ABI arg) -> stack
+		} else {
+			// The 9th+ float64 arguments arrive on the caller's stack,
+			// just above the return address, at [rbp+16], [rbp+24], ...
+			callerOff := 16 + 8*(i-8)
+			b.emit(mov_x_rbp_xmm(callerOff, 0), mov_xmm_x_rbp(0, off))
+		}
+	}
+	b.compileSSA(instrs, alloc)       // function body (jit code)
+	b.loadSSAValue(rootVal, alloc, 0) // final result into xmm0
+	b.emit(add_rsp(frameSize))        // free stack space
+	b.emit(pop_rbp, ret)              // return from function
+
+	return b.Bytes(), compileStats{maxReg: amd64RegBase + amd64NumRegs - 1, nStackSpill: numSpillSlots(alloc)}
+}
+
+func (amd64Arch) makeExecutable(code []byte) (*Code, error) {
+	instr, err := MakeExecutable(code)
+	if err != nil {
+		return nil, err
+	}
+	return &Code{instr}, nil
+}
+
+// buf accumulates amd64 machine code.
+type buf struct {
+	bytes.Buffer
+	params    map[string]int // variable name -> rbp-relative stack offset
+	numParams int            // len(params); spill slots are stacked below them
+}
+
+// emit writes machine code to the buffer.
+func (b *buf) emit(ops ...[]byte) {
+	for _, op := range ops {
+		b.Write(op)
+	}
+}
+
+// compileSSA emits code for instrs in order, consulting alloc for where
+// each value's operands live and where its result should end up.
+func (b *buf) compileSSA(instrs []ssaInstr, alloc []ssaAlloc) {
+	for i, in := range instrs {
+		switch in.op {
+		case ssaConst:
+			b.emit(mov_float_rax(in.c), mov_rax_xmm0)
+		case ssaArg:
+			b.compileVariable(in.name)
+		case ssaCall:
+			fptr := funcs[in.name]
+			if fptr == 0 {
+				panic(fmt.Sprintf("undefined: %s", in.name))
+			}
+			b.loadSSAValue(in.a, alloc, 0)
+			b.emit(mov_uint_rax(fptr), call_rax)
+		case ssaLt, ssaLe, ssaGt, ssaGe, ssaEq, ssaNe:
+			b.compileCompare(in, alloc)
+		case ssaSelect:
+			b.compileSelect(in, alloc)
+		default:
+			b.loadSSAValue(in.b, alloc, 1)
+			b.loadSSAValue(in.a, alloc, 0)
+			b.emit(binOpcode(in.op))
+		}
+		b.storeSSAValue(i, alloc, 0)
+	}
+}
+
+// loadSSAValue emits code to move SSA value v's home (register or stack
+// slot) into xmm register dst.
+func (b *buf) loadSSAValue(v int, alloc []ssaAlloc, dst int) {
+	a := alloc[v]
+	if a.reg >= 0 {
+		if a.reg != dst {
+			b.emit(mov_xmm(a.reg, dst))
+		}
+	} else {
+		b.emit(mov_x_rbp_xmm(b.spillOffset(a.slot), dst))
+	}
+}
+
+// storeSSAValue emits code to move xmm register src into SSA value v's home.
+func (b *buf) storeSSAValue(v int, alloc []ssaAlloc, src int) {
+	a := alloc[v]
+	if a.reg >= 0 {
+		if a.reg != src {
+			b.emit(mov_xmm(src, a.reg))
+		}
+	} else {
+		b.emit(mov_xmm_x_rbp(src, b.spillOffset(a.slot)))
+	}
+}
+
+// spillOffset returns the rbp-relative byte offset of spill slot, stacked
+// below the parameter slots.
+func (b *buf) spillOffset(slot int) int {
+	return -8*b.numParams - 8*(slot+1)
+}
+
+// binOpcode returns the machine code for a binary SSA op, operating on
+// xmm0 (left-hand side) and xmm1 (right-hand side), result in xmm0.
+func binOpcode(op ssaOp) []byte {
+	switch op {
+	case ssaAdd:
+		return add_xmm1_xmm0
+	case ssaSub:
+		return sub_xmm1_xmm0
+	case ssaMul:
+		return mul_xmm1_xmm0
+	case ssaDiv:
+		return div_xmm1_xmm0
+	case ssaMin:
+		return minsd_xmm1_xmm0
+	case ssaMax:
+		return maxsd_xmm1_xmm0
+	default:
+		panic(op)
+	}
+}
+
+// compileCompare emits a comparison, producing 0.0 (false) or 1.0 (true):
+// cmppd selects an all-ones or all-zero mask per lane, which andpd then
+// masks against 1.0 (loaded into xmm1's low lane only; the upper lane is
+// zero and unused).
+func (b *buf) compileCompare(in ssaInstr, alloc []ssaAlloc) {
+	lhs, rhs := in.a, in.b
+	if in.op == ssaGt || in.op == ssaGe {
+		// cmppd has no GT/GE predicate: evaluate as the swapped LT/LE.
+		lhs, rhs = rhs, lhs
+	}
+	b.loadSSAValue(rhs, alloc, 1)
+	b.loadSSAValue(lhs, alloc, 0)
+	b.emit(cmppd_xmm1_xmm0(cmpPredicate(in.op)))
+	b.emit(mov_float_rax(1.0), mov_rax_xmm1, and_xmm1_xmm0)
+}
+
+// cmpPredicate maps a comparison SSA op to the cmppd immediate predicate,
+// folding GT/GE into their LT/LE swapped-operand equivalents.
+func cmpPredicate(op ssaOp) byte {
+	switch op {
+	case ssaEq:
+		return 0
+	case ssaLt, ssaGt:
+		return 1
+	case ssaLe, ssaGe:
+		return 2
+	case ssaNe:
+		return 4
+	default:
+		panic(op)
+	}
+}
+
+// compileSelect emits select(cond, a, b) branchlessly as
+// cond*a + (1-cond)*b, using xmm8/xmm9 as scratch since they fall outside
+// the linear-scan allocator's xmm2..xmm7 window.
+func (b *buf) compileSelect(in ssaInstr, alloc []ssaAlloc) {
+	b.loadSSAValue(in.a, alloc, 0)           // xmm0 = cond
+	b.emit(mov_xmm(0, 8))                    // xmm8 = cond
+	b.loadSSAValue(in.b, alloc, 1)           // xmm1 = thenVal
+	b.emit(mul_xmm0_xmm1)                    // xmm1 = cond * thenVal
+	b.emit(mov_xmm(1, 9))                    // xmm9 = cond * thenVal
+	b.loadSSAValue(in.t, alloc, 1)           // xmm1 = elseVal
+	b.emit(mov_float_rax(1.0), mov_rax_xmm0) // xmm0 = 1.0
+	b.emit(sub_xmm8_xmm0)                    // xmm0 = 1.0 - cond
+	b.emit(mul_xmm0_xmm1)                    // xmm1 = (1-cond) * elseVal
+	b.emit(mov_xmm(9, 0))                    // xmm0 = cond * thenVal
+	b.emit(add_xmm1_xmm0)                    // xmm0 += xmm1
+}
+
+// minsd_xmm1_xmm0 computes xmm0 = min(xmm0, xmm1) (SSE2 MINSD).
+var minsd_xmm1_xmm0 = []byte{0xF2, 0x0F, 0x5D, 0xC1}
+
+// maxsd_xmm1_xmm0 computes xmm0 = max(xmm0, xmm1) (SSE2 MAXSD).
+var maxsd_xmm1_xmm0 = []byte{0xF2, 0x0F, 0x5F, 0xC1}
+
+// and_xmm1_xmm0 computes xmm0 &= xmm1 (SSE2 ANDPD), used by compileCompare
+// to mask a cmppd result against 1.0.
+var and_xmm1_xmm0 = []byte{0x66, 0x0F, 0x54, 0xC1}
+
+// cmppd_xmm1_xmm0 computes xmm0 = cmppd(xmm0, xmm1, predicate) (SSE2
+// CMPPD), an all-ones or all-zero mask per lane depending on predicate
+// (see cmpPredicate).
+func cmppd_xmm1_xmm0(predicate byte) []byte {
+	return []byte{0x66, 0x0F, 0xC2, 0xC1, predicate}
+}
+
+// --- base SSE2 scalar instruction encoding ---------------------------------
+//
+// There is no assembler in the loop here either: these are the primitives
+// buf.emit calls throughout this file (preamble/epilogue, stack-relative
+// loads/stores, arithmetic, and the immediate/call sequence compileSSA's
+// ssaCall case uses to reach into funcs), hand-encoded the same way as the
+// SSE2 min/max/compare helpers above.
+
+// push_rbp/pop_rbp and mov_rsp_rbp round out the function preamble/epilogue
+// alongside sub_rsp/add_rsp and ret.
+var (
+	push_rbp    = []byte{0x55}
+	pop_rbp     = []byte{0x5D}
+	mov_rsp_rbp = []byte{0x48, 0x89, 0xE5} // MOV RBP, RSP
+	ret         = []byte{0xC3}
+)
+
+// sub_rsp/add_rsp adjust rsp by an immediate (REX.W ADD/SUB r/m64, imm32),
+// reserving or releasing the frame's local stack space.
+func sub_rsp(n int) []byte { return rspImm(0xEC, n) } // SUB RSP, imm32 (/5)
+func add_rsp(n int) []byte { return rspImm(0xC4, n) } // ADD RSP, imm32 (/0)
+
+func rspImm(modrm byte, n int) []byte {
+	out := []byte{0x48, 0x81, modrm, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(out[3:], uint32(int32(n)))
+	return out
+}
+
+// sseRegReg encodes a scalar-double (F2 0F) register-to-register SSE2
+// instruction, REX-prefixing dst/src when either is xmm8 or above (as
+// compileSelect's xmm8/xmm9 scratch registers are).
+func sseRegReg(opcode byte, dst, src int) []byte {
+	out := []byte{0xF2}
+	if dst >= 8 || src >= 8 {
+		rex := byte(0x40)
+		if dst >= 8 {
+			rex |= 0x04 // REX.R
+		}
+		if src >= 8 {
+			rex |= 0x01 // REX.B
+		}
+		out = append(out, rex)
+	}
+	return append(out, 0x0F, opcode, 0xC0|byte(dst&7)<<3|byte(src&7))
+}
+
+// mov_xmm copies xmm(src) into xmm(dst) (MOVSD, register-to-register).
+func mov_xmm(src, dst int) []byte { return sseRegReg(0x10, dst, src) }
+
+// add_xmm1_xmm0/sub_xmm1_xmm0/mul_xmm1_xmm0/div_xmm1_xmm0 compute
+// xmm0 = xmm0 op xmm1 (ADDSD/SUBSD/MULSD/DIVSD), binOpcode's workhorses.
+var (
+	add_xmm1_xmm0 = sseRegReg(0x58, 0, 1)
+	sub_xmm1_xmm0 = sseRegReg(0x5C, 0, 1)
+	mul_xmm1_xmm0 = sseRegReg(0x59, 0, 1)
+	div_xmm1_xmm0 = sseRegReg(0x5E, 0, 1)
+)
+
+// mul_xmm0_xmm1 computes xmm1 = xmm1 * xmm0 (MULSD), used by compileSelect
+// where the destination is xmm1 rather than xmm0.
+var mul_xmm0_xmm1 = sseRegReg(0x59, 1, 0)
+
+// sub_xmm8_xmm0 computes xmm0 = xmm0 - xmm8 (SUBSD), compileSelect's
+// "1.0 - cond" step.
+var sub_xmm8_xmm0 = sseRegReg(0x5C, 0, 8)
+
+// movsdRbpDisp encodes a scalar-double load/store between xmmReg and
+// [rbp+off] (disp32 form, since param and spill offsets routinely exceed a
+// disp8's range).
+func movsdRbpDisp(opcode byte, reg, off int) []byte {
+	out := []byte{0xF2}
+	if reg >= 8 {
+		out = append(out, 0x44) // REX.R
+	}
+	out = append(out, 0x0F, opcode, 0x80|byte(reg&7)<<3|5, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(int32(off)))
+	return out
+}
+
+// mov_xmm_x_rbp stores xmm(reg) to [rbp+off] (MOVSD).
+func mov_xmm_x_rbp(reg, off int) []byte { return movsdRbpDisp(0x11, reg, off) }
+
+// mov_x_rbp_xmm loads [rbp+off] into xmm(reg) (MOVSD).
+func mov_x_rbp_xmm(off, reg int) []byte { return movsdRbpDisp(0x10, reg, off) }
+
+// mov_float_rax loads v's bit pattern into rax (MOVABS); mov_rax_xmm0 then
+// moves it into xmm0, the pair ssaConst and compileCompare/compileSelect
+// use to materialize float64 immediates (there is no SSE2 instruction for
+// a 64-bit immediate directly into an xmm register).
+func mov_float_rax(v float64) []byte { return movAbsRax(math.Float64bits(v)) }
+
+// mov_uint_rax loads a host function pointer into rax (MOVABS), for
+// compileSSA's ssaCall case to then call through with call_rax.
+func mov_uint_rax(v uintptr) []byte { return movAbsRax(uint64(v)) }
+
+func movAbsRax(bits uint64) []byte {
+	out := []byte{0x48, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(out[2:], bits)
+	return out
+}
+
+// mov_rax_xmm0/mov_rax_xmm1 move rax into xmm0/xmm1 (MOVQ), used to get a
+// float64 immediate (staged in rax by mov_float_rax) into an xmm register.
+var (
+	mov_rax_xmm0 = []byte{0x66, 0x48, 0x0F, 0x6E, 0xC0}
+	mov_rax_xmm1 = []byte{0x66, 0x48, 0x0F, 0x6E, 0xC8}
+)
+
+// call_rax calls the address in rax (CALL r/m64, /2).
+var call_rax = []byte{0xFF, 0xD0}
+
+func (b *buf) compileVariable(name string) {
+	off, ok := b.params[name]
+	if !ok {
+		// Unreachable: CompileWithParams validates variable names up front.
+		panic("undefined variable:" + name)
+	}
+	b.emit(mov_x_rbp_xmm(off, 0))
+}
+
+// dump saves the code to a file so it can be inspected. E.g. using:
+//
+//	objdump -D -b binary -m i386:x86-64 --insn-width 10 filename
+func (b *buf) dump(fname string) {
+	f, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	f.Write(b.Bytes())
+}
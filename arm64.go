@@ -0,0 +1,462 @@
+package jit
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// arm64Arch is the arch backend for GOARCH=="arm64". It emits NEON/FP scalar
+// double-precision code (d0-d31), with the same fp-relative parameter
+// layout as the amd64 backend. Unlike amd64 it walks the expression tree
+// directly, choosing evaluation order by call depth, rather than going
+// through the SSA lowering.
+type arm64Arch struct{}
+
+func (arm64Arch) compile(root expr, params []string, hasCall map[expr]bool, callDepth map[expr]int) ([]byte, compileStats) {
+	paramOffset := make(map[string]int, len(params))
+	for i, p := range params {
+		paramOffset[p] = -8 * (i + 1)
+	}
+
+	frameSize := 8 * len(params)
+	if frameSize%16 != 0 {
+		frameSize += 8 // keep the frame 16-byte aligned
+	}
+
+	b := abuf{hasCall: hasCall, callDepth: callDepth, params: paramOffset, numParams: len(params)}
+
+	b.emit(stp_fp_lr_sp, mov_sp_fp) // function preamble
+	b.emit(sub_sp(frameSize))       // stack space for params
+	for i, p := range params {
+		off := paramOffset[p]
+		if i < 8 {
+			b.emit(str_d_fp(i, off)) // dN (AAPCS64 arg) -> stack
+		} else {
+			// The 9th+ float64 arguments arrive on the caller's stack,
+			// just above the saved fp/lr, at [fp+16], [fp+24], ...
+			callerOff := 16 + 8*(i-8)
+			b.emit(ldr_d_fp(callerOff, 0), str_d_fp(0, off))
+		}
+	}
+	b.compileExpr(root)           // function body (jit code)
+	b.emit(add_sp(frameSize))     // free stack space
+	b.emit(ldp_fp_lr_sp, ret_arm) // return from function
+
+	return b.Bytes(), compileStats{b.nRegistersHit, b.nStackSpill, b.maxReg}
+}
+
+func (arm64Arch) makeExecutable(code []byte) (*Code, error) {
+	instr, err := MakeExecutable(code)
+	if err != nil {
+		return nil, err
+	}
+	// arm64 has separate instruction and data caches, so freshly written
+	// code must be made visible to the I-cache before it is ever called.
+	// Flush instr (the actual executable mapping), not code (the
+	// caller-supplied bytes that were only copied from) -- those live at a
+	// different address and were never fetched for execution.
+	flushInstructionCache(instr)
+	return &Code{instr}, nil
+}
+
+// abuf accumulates arm64 machine code. Intermediate results are stashed in
+// d2-d15 (see allocReg), or pushed on the stack when none is free.
+type abuf struct {
+	bytes.Buffer
+	usedReg                            [16]bool // d0-d15; d2-d15 available to the allocator
+	nRegistersHit, nStackSpill, maxReg int
+	hasCall                            map[expr]bool
+	callDepth                          map[expr]int
+	params                             map[string]int // variable name -> fp-relative stack offset
+	numParams                          int
+}
+
+func (b *abuf) emit(ops ...[]byte) {
+	for _, op := range ops {
+		b.Write(op)
+	}
+}
+
+// stash emits code for moving d0 to a free register.
+// If no registers are free or destroyRegs == true, the stack is used instead.
+// It returns the register number used, or -1 if the stack was used.
+func (b *abuf) stash(destroyRegs bool) int {
+	reg := -1
+	if !destroyRegs {
+		reg = b.allocReg()
+	} else {
+		b.nStackSpill++
+	}
+	if reg == -1 {
+		b.emit(str_d_presp(0)) // push d0
+	} else {
+		b.emit(fmov_d(0, reg))
+	}
+	return reg
+}
+
+// unstash is the inverse of stash: it moves the stashed value into d0 or d1
+// (specified by dest).
+func (b *abuf) unstash(reg, dest int) {
+	switch {
+	case reg == -1:
+		b.emit(ldr_d_postsp(dest)) // pop into d(dest)
+	case reg != -1:
+		b.emit(fmov_d(reg, dest))
+	default:
+		panic("bug")
+	}
+	b.freeReg(reg)
+}
+
+// allocReg returns a free d register (d2-d15), or -1 if all are in use.
+func (b *abuf) allocReg() int {
+	if !useRegisters {
+		b.nStackSpill++
+		return -1
+	}
+	for i := 2; i < len(b.usedReg); i++ {
+		if !b.usedReg[i] {
+			b.usedReg[i] = true
+			b.nRegistersHit++
+			if i > b.maxReg {
+				b.maxReg = i
+			}
+			return i
+		}
+	}
+	b.nStackSpill++
+	return -1
+}
+
+// freeReg must be called when a register returned by allocReg is no longer needed.
+func (b *abuf) freeReg(reg int) {
+	if reg == -1 {
+		return
+	}
+	if !b.usedReg[reg] {
+		panic(fmt.Sprint("register double free", reg))
+	}
+	b.usedReg[reg] = false
+}
+
+func (b *abuf) compileExpr(e expr) {
+	switch e := e.(type) {
+	default:
+		panic(fmt.Sprintf("compileExpr %T", e))
+	case binexpr:
+		b.compileBinexpr(e)
+	case callexpr:
+		b.compileCallexpr(e)
+	case constant:
+		b.compileConstant(e)
+	case variable:
+		b.compileVariable(e)
+	case selectexpr:
+		b.compileSelectexpr(e)
+	}
+}
+
+func (b *abuf) compileVariable(e variable) {
+	off, ok := b.params[e.name]
+	if !ok {
+		// Unreachable: CompileWithParams validates variable names up front.
+		panic("undefined variable:" + e.name)
+	}
+	b.emit(ldr_d_fp(off, 0))
+}
+
+func (b *abuf) compileConstant(e constant) {
+	b.emit(mov_float_x0(e.value), fmov_x0_d0)
+}
+
+func (b *abuf) compileBinexpr(e binexpr) {
+	// Evaluation-order heuristic: prefer the deeper branch first, unless the other branch contains a call (which
+	// clobbers every caller-saved d register anyway).
+	var first, second expr
+	if b.callDepth[e.x] > b.callDepth[e.y] && !b.hasCall[e.y] {
+		first, second = e.x, e.y
+	} else {
+		first, second = e.y, e.x
+	}
+
+	b.compileExpr(first)
+	stash := b.stash(b.hasCall[second])
+	b.compileExpr(second)
+
+	// Move the results back:
+	// x -> d0
+	// y -> d1
+	if first == e.y {
+		b.unstash(stash, 1)
+	} else {
+		b.emit(fmov_d(0, 1))
+		b.unstash(stash, 0)
+	}
+
+	switch e.op {
+	case "+":
+		b.emit(fadd_d1_d0)
+	case "-":
+		b.emit(fsub_d1_d0)
+	case "*":
+		b.emit(fmul_d1_d0)
+	case "/":
+		b.emit(fdiv_d1_d0)
+	case "min":
+		b.emit(fmin_d1_d0)
+	case "max":
+		b.emit(fmax_d1_d0)
+	case "<", "<=", ">", ">=", "==", "!=":
+		b.emit(fcmp_d0_d1, cset_w0(armCond(e.op)), scvtf_w0_d0)
+	default:
+		panic(e.op)
+	}
+}
+
+// armCond maps a comparison operator to the arm64 condition code used by
+// cset. Unlike x86's cmppd, arm64's flags-based fcmp supports all six
+// comparisons directly, so no operand swapping is needed.
+func armCond(op string) string {
+	switch op {
+	case "<":
+		return "lt"
+	case "<=":
+		return "le"
+	case ">":
+		return "gt"
+	case ">=":
+		return "ge"
+	case "==":
+		return "eq"
+	case "!=":
+		return "ne"
+	default:
+		panic(op)
+	}
+}
+
+// compileSelectexpr emits select(cond, a, b) branchlessly as
+// cond*a + (1-cond)*b, using d16-d18 as scratch since they fall outside
+// the register allocator's d2-d15 window.
+func (b *abuf) compileSelectexpr(e selectexpr) {
+	b.compileExpr(e.cond)                 // d0 = cond
+	b.emit(fmov_d(0, 16))                 // d16 = cond
+	b.compileExpr(e.a)                    // d0 = thenVal
+	b.emit(fmul_d0_d16)                   // d0 = thenVal * cond
+	b.emit(fmov_d(0, 17))                 // d17 = cond * thenVal
+	b.compileExpr(e.b)                    // d0 = elseVal
+	b.emit(fmov_d(0, 18))                 // d18 = elseVal
+	b.emit(mov_float_x0(1.0), fmov_x0_d0) // d0 = 1.0
+	b.emit(fsub_d16_d0)                   // d0 = 1.0 - cond
+	b.emit(fmul_d0_d18)                   // d0 = (1-cond) * elseVal
+	b.emit(fmov_d(0, 1))                  // d1 = (1-cond) * elseVal
+	b.emit(fmov_d(17, 0))                 // d0 = cond * thenVal
+	b.emit(fadd_d1_d0)                    // d0 += d1
+}
+
+// flushInstructionCache makes code, just written into an executable page,
+// visible to the CPU's instruction fetch path. Unlike amd64, arm64 does not
+// guarantee I/D cache coherency for freshly written code, so this must run
+// once before the page is ever entered via Code.Eval.
+//
+// There is no portable "flush the icache" syscall on linux/arm64 (the
+// ARM cacheflush syscall is an arm (32-bit) only); the documented way to
+// do this from userspace, and what glibc's __clear_cache does, is to
+// issue the DC CVAU / IC IVAU cache-maintenance instructions directly
+// over the affected range. clearCache does exactly that, in
+// cache_arm64.s.
+func flushInstructionCache(code []byte) {
+	if len(code) == 0 {
+		return
+	}
+	start := uintptr(unsafe.Pointer(&code[0]))
+	end := start + uintptr(len(code))
+	clearCache(start, end)
+}
+
+// clearCache cleans the data cache and invalidates the instruction cache
+// for [start, end) to the point of unification, then issues the barriers
+// needed for the two to become coherent. Implemented in cache_arm64.s
+// (cache_amd64.s's clearCache is a no-op stub, only so this links there
+// too -- see its comment).
+func clearCache(start, end uintptr)
+
+// compileCallexpr emits an ABI-correct call to a host function: the target
+// is materialized into x16 (the platform's designated intra-procedure-call
+// scratch register) and invoked with blr, matching the arm64 procedure call
+// standard used for indirect calls to jitted/foreign code.
+func (b *abuf) compileCallexpr(e callexpr) {
+	fptr := funcs[e.fun]
+	if fptr == 0 {
+		panic(fmt.Sprintf("undefined: %s", e.fun))
+	}
+
+	b.compileExpr(e.arg)
+	b.emit(mov_uint_x16(fptr), blr_x16)
+}
+
+// --- arm64 instruction encoding -------------------------------------------
+//
+// Everything below emits raw AArch64 machine code (little-endian 32-bit
+// words, per the A64 instruction set) for the small fixed set of
+// instructions abuf needs. There is no assembler in the loop: each
+// function builds the bit pattern directly from the manual, the same way
+// amd64.go hand-encodes SSE2 bytes.
+
+// le32 appends the little-endian encoding of a 32-bit A64 instruction.
+func le32(w uint32) []byte {
+	return []byte{byte(w), byte(w >> 8), byte(w >> 16), byte(w >> 24)}
+}
+
+// Fixed-sequence instructions used by the function preamble/epilogue: the
+// frame always begins by saving fp/lr in a pre-indexed pair and ends by
+// restoring them post-indexed, so these never need a parameterized offset.
+var (
+	stp_fp_lr_sp = le32(0xA9BF7BFD) // stp x29, x30, [sp, #-16]!
+	mov_sp_fp    = le32(0x910003FD) // mov x29, sp
+	ldp_fp_lr_sp = le32(0xA8C17BFD) // ldp x29, x30, [sp], #16
+	ret_arm      = le32(0xD65F03C0) // ret
+)
+
+// sub_sp and add_sp adjust sp by an immediate, for the frame's local stack
+// space. imm must be a non-negative multiple of 16 representable in the
+// 12-bit (optionally <<12) immediate field ADD/SUB (immediate) provides;
+// compile's frameSize is always rounded to 16 bytes, so that's never an
+// issue in practice here.
+func sub_sp(imm int) []byte { return addSubSPImm(0xD1000000, imm) }
+func add_sp(imm int) []byte { return addSubSPImm(0x91000000, imm) }
+
+func addSubSPImm(base uint32, imm int) []byte {
+	shift := uint32(0)
+	v := uint32(imm)
+	if v > 0xFFF {
+		if v&0xFFF != 0 {
+			panic(fmt.Sprintf("arm64: immediate %d does not fit ADD/SUB (imm12[,LSL#12])", imm))
+		}
+		v >>= 12
+		shift = 1
+	}
+	const rd, rn = 31, 31 // sp
+	return le32(base | shift<<22 | (v&0xFFF)<<10 | rn<<5 | rd)
+}
+
+// str_d_fp/ldr_d_fp move dN to/from [x29, #off] using the unscaled
+// immediate (STUR/LDUR) encoding, so off may be negative -- every
+// parameter and spill slot lives below the frame pointer.
+func str_d_fp(reg, off int) []byte { return sturLdurD(0xFC000000, reg, 29, off) }
+func ldr_d_fp(off, reg int) []byte { return sturLdurD(0xFC400000, reg, 29, off) }
+
+func sturLdurD(base uint32, rt, rn, simm int) []byte {
+	return le32(base | uint32(simm&0x1FF)<<12 | uint32(rn&0x1F)<<5 | uint32(rt&0x1F))
+}
+
+// str_d_presp/ldr_d_postsp push/pop a single dN via the stack, used by
+// abuf.stash/unstash when no register is free.
+func str_d_presp(reg int) []byte {
+	return le32(0xFC000C00 | uint32(-8&0x1FF)<<12 | 31<<5 | uint32(reg&0x1F))
+}
+func ldr_d_postsp(reg int) []byte {
+	return le32(0xFC400400 | uint32(8&0x1FF)<<12 | 31<<5 | uint32(reg&0x1F))
+}
+
+// fmov_d emits "fmov dDst, dSrc" (register-to-register FP move).
+func fmov_d(src, dst int) []byte {
+	return le32(0x1E604000 | uint32(src&0x1F)<<5 | uint32(dst&0x1F))
+}
+
+// fOp2 encodes the FP (scalar, 2-source) data-processing instructions:
+// FADD/FSUB/FMUL/FDIV/FMAX/FMIN Dd, Dn, Dm.
+func fOp2(opcode uint32, rd, rn, rm int) []byte {
+	return le32(0x1E600800 | uint32(rm&0x1F)<<16 | opcode<<12 | uint32(rn&0x1F)<<5 | uint32(rd&0x1F))
+}
+
+const (
+	fOpMul = 0
+	fOpDiv = 1
+	fOpAdd = 2
+	fOpSub = 3
+	fOpMax = 4
+	fOpMin = 5
+)
+
+var (
+	fadd_d1_d0 = fOp2(fOpAdd, 0, 0, 1)
+	fsub_d1_d0 = fOp2(fOpSub, 0, 0, 1)
+	fmul_d1_d0 = fOp2(fOpMul, 0, 0, 1)
+	fdiv_d1_d0 = fOp2(fOpDiv, 0, 0, 1)
+	fmin_d1_d0 = fOp2(fOpMin, 0, 0, 1)
+	fmax_d1_d0 = fOp2(fOpMax, 0, 0, 1)
+
+	// compileSelectexpr's scratch-register (d16-d18) lowering of
+	// cond*a + (1-cond)*b.
+	fmul_d0_d16 = fOp2(fOpMul, 0, 0, 16)
+	fsub_d16_d0 = fOp2(fOpSub, 0, 0, 16) // d0 = d0 - d16, i.e. 1.0 - cond
+	fmul_d0_d18 = fOp2(fOpMul, 0, 0, 18)
+)
+
+// fcmp_d0_d1 emits "fcmp d0, d1", setting the condition flags cset_w0
+// reads.
+var fcmp_d0_d1 = le32(0x1E602000 | 1<<16)
+
+// armCondCode maps the condition mnemonics armCond returns to their A64
+// encoding.
+var armCondCode = map[string]uint32{
+	"eq": 0x0, "ne": 0x1,
+	"ge": 0xA, "lt": 0xB,
+	"gt": 0xC, "le": 0xD,
+}
+
+// cset_w0 emits "cset w0, cond". CSET is an alias for
+// CSINC Wd, WZR, WZR, invert(cond); A64 condition codes are arranged so
+// that inversion is just flipping the low bit.
+func cset_w0(cond string) []byte {
+	code, ok := armCondCode[cond]
+	if !ok {
+		panic("arm64: unknown condition " + cond)
+	}
+	inv := code ^ 1
+	return le32(0x1A9F07E0 | inv<<12)
+}
+
+// scvtf_w0_d0 emits "scvtf d0, w0", converting cset's 0/1 result to a
+// 0.0/1.0 double.
+var scvtf_w0_d0 = le32(0x1E620000)
+
+// fmov_x0_d0 moves x0 into d0, getting a float64 immediate staged in x0 by
+// mov_float_x0 into the FP register file (moves among FP registers, such
+// as compileSelectexpr's d16-d18 scratch registers, use fmov_d).
+var fmov_x0_d0 = le32(0x9E670000) // fmov d0, x0
+
+// mov_float_x0 loads a float64 bit pattern into x0 via MOVZ/MOVK, since
+// A64 has no single instruction for a 64-bit immediate.
+func mov_float_x0(v float64) []byte {
+	return movImm64(0, math.Float64bits(v))
+}
+
+// mov_uint_x16 is mov_float_x0's counterpart for loading a host function
+// pointer into x16, the scratch register compileCallexpr calls through.
+func mov_uint_x16(v uintptr) []byte {
+	return movImm64(16, uint64(v))
+}
+
+func movImm64(rd int, bits uint64) []byte {
+	var out []byte
+	out = append(out, movWideImm(0xD2800000, rd, uint16(bits), 0)...) // movz
+	out = append(out, movWideImm(0xF2800000, rd, uint16(bits>>16), 1)...)
+	out = append(out, movWideImm(0xF2800000, rd, uint16(bits>>32), 2)...)
+	out = append(out, movWideImm(0xF2800000, rd, uint16(bits>>48), 3)...)
+	return out
+}
+
+// movWideImm encodes MOVZ (base 0xD2800000) / MOVK (base 0xF2800000)
+// Xd, #imm16, LSL #(16*hw).
+func movWideImm(base uint32, rd int, imm16 uint16, hw uint32) []byte {
+	return le32(base | hw<<21 | uint32(imm16)<<5 | uint32(rd&0x1F))
+}
+
+// blr_x16 emits "blr x16", calling through the pointer compileCallexpr
+// just materialized there.
+var blr_x16 = le32(0xD63F0000 | 16<<5)
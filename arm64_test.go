@@ -0,0 +1,55 @@
+package jit
+
+import (
+	"runtime"
+	"testing"
+)
+
+// TestCompileForArchSelection exercises CompileFor's dispatch: both
+// supported backends must compile the same expression without error, and
+// an unrecognized GOARCH must be rejected rather than panicking somewhere
+// deep in codegen.
+func TestCompileForArchSelection(t *testing.T) {
+	const expr = "select(x<y, x, y) + min(x, y) - max(x, y)"
+
+	amd64Code, err := CompileFor("amd64", expr)
+	if err != nil {
+		t.Fatalf("CompileFor(amd64): %v", err)
+	}
+	defer amd64Code.Free()
+
+	arm64Code, err := CompileFor("arm64", expr)
+	if err != nil {
+		t.Fatalf("CompileFor(arm64): %v", err)
+	}
+	defer arm64Code.Free()
+
+	if _, err := CompileFor("riscv64", expr); err == nil {
+		t.Fatalf("CompileFor(riscv64): expected an error, got nil")
+	}
+}
+
+// TestCompileArm64Eval runs actual arm64-targeted code only when the test
+// binary itself is running on arm64 -- cross-arch machine code can be
+// emitted from any host but can only be safely entered on that host.
+func TestCompileArm64Eval(t *testing.T) {
+	if runtime.GOARCH != "arm64" {
+		t.Skip("only runs when the test binary itself is arm64")
+	}
+	c, err := CompileFor("arm64", "select(x<0, -x, x)") // abs(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Free()
+
+	for _, x := range []float64{-3, 0, 4} {
+		got := c.Eval(x, 0)
+		want := x
+		if want < 0 {
+			want = -want
+		}
+		if got != want {
+			t.Errorf("abs(%v) = %v, want %v", x, got, want)
+		}
+	}
+}
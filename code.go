@@ -0,0 +1,117 @@
+package jit
+
+import (
+	"fmt"
+	"math"
+	"syscall"
+	"unsafe"
+)
+
+// expr is an arithmetic expression AST node, as produced by Parse and
+// consumed by FoldConst, lower and each arch backend's compile method. The
+// concrete types are constant, variable, binexpr and callexpr below, plus
+// selectexpr (ssa.go, where select's branchless ternary lowering is first
+// consumed).
+type expr interface {
+	exprNode()
+}
+
+// constant is a numeric literal, e.g. the 2 in x+2.
+type constant struct {
+	value float64
+}
+
+// variable is a reference to one of the names passed to CompileWithParams
+// (or "x"/"y", for Compile/CompileFor).
+type variable struct {
+	name string
+}
+
+// binexpr is a binary operation: +, -, *, /, a comparison, or min/max.
+type binexpr struct {
+	op   string
+	x, y expr
+}
+
+// callexpr is a single-argument call to a host function registered in
+// funcs, e.g. sqrt(x).
+type callexpr struct {
+	fun string
+	arg expr
+}
+
+func (constant) exprNode() {}
+func (variable) exprNode() {}
+func (binexpr) exprNode()  {}
+func (callexpr) exprNode() {}
+
+// funcs maps the name used in a callexpr to the entry address of a host Go
+// function, so each arch backend's compileCallexpr/ssaCall case can emit a
+// direct call to it. Register additional functions here to make them
+// callable from expressions.
+var funcs = map[string]uintptr{
+	"sqrt": funcPC(math.Sqrt),
+	"sin":  funcPC(math.Sin),
+	"cos":  funcPC(math.Cos),
+	"exp":  funcPC(math.Exp),
+	"log":  funcPC(math.Log),
+	"abs":  funcPC(math.Abs),
+}
+
+// funcPC returns the entry address of a host Go function f, e.g.
+// funcPC(math.Sqrt), suitable as the target of a direct CALL/BLR emitted
+// into JIT'd code. f must be a non-nil, non-method func value taking and
+// returning float64.
+func funcPC(f interface{}) uintptr {
+	type iface struct {
+		typ, word unsafe.Pointer
+	}
+	return *(*uintptr)((*iface)(unsafe.Pointer(&f)).word)
+}
+
+// Code is JIT-compiled machine code for a single expression, returned by
+// Compile, CompileFor and CompileWithParams. It must be freed with Free
+// once no longer needed, since the underlying executable mapping is not
+// managed by the garbage collector.
+type Code struct {
+	instr []byte // mmapped and executable; see MakeExecutable
+}
+
+// MakeExecutable copies code into a fresh, page-backed mapping, made
+// executable (and no longer writable, keeping the mapping W^X) via
+// mprotect, and returns it.
+//
+// The mapping is prefixed with an 8-byte pointer to its own first
+// instruction byte (i.e. to mem[8]), followed by code itself starting at
+// that offset. This is what lets Code.Eval and VecCode's evalVec cast the
+// address of a *Code straight to a Go func value: a func value is itself a
+// pointer to a word holding the entry PC, so the call site's one
+// indirection needs something to land on other than the instructions
+// themselves -- the prefix word is that landing spot.
+func MakeExecutable(code []byte) ([]byte, error) {
+	mem, err := syscall.Mmap(-1, 0, len(code)+8, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("jit: mmap: %w", err)
+	}
+	*(*unsafe.Pointer)(unsafe.Pointer(&mem[0])) = unsafe.Pointer(&mem[8])
+	copy(mem[8:], code)
+	if err := syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return nil, fmt.Errorf("jit: mprotect: %w", err)
+	}
+	return mem, nil
+}
+
+// entryAddr returns the address of the first actual instruction byte of
+// c's code, dereferencing the self-pointer MakeExecutable wrote ahead of
+// it. Used wherever the entry address is needed as a plain value rather
+// than via the func-value cast, e.g. to pass to invoke.
+func (c *Code) entryAddr() uintptr {
+	selfPtr := *(*uintptr)(unsafe.Pointer(c))
+	return *(*uintptr)(unsafe.Pointer(selfPtr))
+}
+
+// Free releases the executable mapping backing c. c must not be used
+// again afterwards.
+func (c *Code) Free() error {
+	return syscall.Munmap(c.instr)
+}
@@ -0,0 +1,158 @@
+package jit
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// UndefinedVariableError reports that an expression referenced a variable
+// name that is not in the parameter list passed to CompileWithParams (or
+// "x"/"y", for plain Compile).
+type UndefinedVariableError struct {
+	Name string
+}
+
+func (e *UndefinedVariableError) Error() string {
+	return fmt.Sprintf("jit: undefined variable: %q", e.Name)
+}
+
+// defaultParams preserves the original 2-variable (x, y) API for Compile
+// and CompileFor.
+var defaultParams = []string{"x", "y"}
+
+// CompileWithParams is like Compile, but expr may reference an arbitrary
+// ordered list of parameter names instead of only x and y, e.g.:
+// 	CompileWithParams("a*b+c", []string{"a", "b", "c"})
+// The resulting Code's Eval method takes one argument per entry in params,
+// in the same order. Eval supports at most 8 parameters; len(params) beyond
+// that compiles fine but cannot be Eval'd.
+func CompileWithParams(ex string, params []string) (*Code, error) {
+	return compileParams(runtime.GOARCH, ex, params)
+}
+
+// compileParams is the shared implementation behind Compile, CompileFor and
+// CompileWithParams.
+func compileParams(goarch, ex string, params []string) (c *Code, e error) {
+	a, err := archFor(goarch)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := Parse(ex)
+	if err != nil {
+		return nil, err
+	}
+	if useConstFolding {
+		root = FoldConst(root)
+	}
+	if err := validateParams(root, params); err != nil {
+		return nil, err
+	}
+
+	hasCall := make(map[expr]bool)
+	callDepth := make(map[expr]int)
+	recordCalls(root, hasCall)
+	if useCallDepth {
+		recordDepth(root, callDepth)
+	}
+
+	code, _ := a.compile(root, params, hasCall, callDepth)
+	return a.makeExecutable(code)
+}
+
+// Eval calls the compiled code with one argument per parameter, in the
+// order given to CompileWithParams (or x, y for Compile/CompileFor).
+// Like evalVec, it relies on the System V AMD64 / AAPCS64 float64 calling
+// convention aligning with Go's: both pass the first 8 float64 arguments in
+// the same sequence of FP registers, so the raw code pointer can be cast
+// directly to a Go func value. Go requires that func type to have a fixed
+// arity, so Eval switches on len(args) to pick it; more than 8 arguments
+// isn't supported, since beyond that point the two calling conventions
+// diverge (stack layout) in ways this trick can't paper over.
+func (c *Code) Eval(args ...float64) float64 {
+	switch len(args) {
+	case 0:
+		return (*(*func() float64)(unsafe.Pointer(c)))()
+	case 1:
+		return (*(*func(float64) float64)(unsafe.Pointer(c)))(args[0])
+	case 2:
+		return (*(*func(float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1])
+	case 3:
+		return (*(*func(float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2])
+	case 4:
+		return (*(*func(float64, float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2], args[3])
+	case 5:
+		return (*(*func(float64, float64, float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2], args[3], args[4])
+	case 6:
+		return (*(*func(float64, float64, float64, float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2], args[3], args[4], args[5])
+	case 7:
+		return (*(*func(float64, float64, float64, float64, float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2], args[3], args[4], args[5], args[6])
+	case 8:
+		return (*(*func(float64, float64, float64, float64, float64, float64, float64, float64) float64)(unsafe.Pointer(c)))(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7])
+	default:
+		panic(fmt.Sprintf("jit: Eval: %d arguments not supported (max 8)", len(args)))
+	}
+}
+
+// invoke calls fn (a JIT-compiled function's code pointer) with one
+// argument per entry in args, under the host's native float64 calling
+// convention (System V AMD64 / AAPCS64), handling parameter lists beyond
+// the 8 that fit in Eval's fixed-arity Go func casts. Implemented in
+// invoke_amd64.s / invoke_arm64.s.
+func invoke(fn uintptr, args []float64) float64
+
+// EvalSlice is like Eval, but takes args as a slice rather than a fixed
+// arity, so it also supports parameter lists beyond Eval's 8-argument
+// ceiling: CompileWithParams happily compiles those (the
+// amd64/arm64 backends read the 9th+ parameter off the caller's stack
+// frame), and EvalSlice is what actually calls into that code path, via
+// the invoke trampoline.
+//
+// This name collides with VecCode.EvalSlice, which evaluates a whole
+// batch of (x, y) pairs rather than a single argument list; the two
+// aren't related.
+func (c *Code) EvalSlice(args []float64) float64 {
+	if len(args) <= 8 {
+		return c.Eval(args...)
+	}
+	return invoke(c.entryAddr(), args)
+}
+
+// validateParams reports the first variable reference in root whose name
+// is not in params, as a *UndefinedVariableError, instead of letting the
+// emitter panic deep inside code generation.
+func validateParams(root expr, params []string) error {
+	valid := make(map[string]bool, len(params))
+	for _, p := range params {
+		valid[p] = true
+	}
+
+	var walk func(e expr) error
+	walk = func(e expr) error {
+		switch e := e.(type) {
+		case variable:
+			if !valid[e.name] {
+				return &UndefinedVariableError{Name: e.name}
+			}
+		case binexpr:
+			if err := walk(e.x); err != nil {
+				return err
+			}
+			return walk(e.y)
+		case callexpr:
+			return walk(e.arg)
+		case selectexpr:
+			if err := walk(e.cond); err != nil {
+				return err
+			}
+			if err := walk(e.a); err != nil {
+				return err
+			}
+			return walk(e.b)
+		}
+		return nil
+	}
+
+	return walk(root)
+}
@@ -0,0 +1,58 @@
+package jit
+
+import "testing"
+
+// TestCompileWithParamsUndefinedVariable checks that referencing a
+// variable outside the parameter list is reported as a
+// *UndefinedVariableError up front, rather than panicking during codegen.
+func TestCompileWithParamsUndefinedVariable(t *testing.T) {
+	_, err := CompileWithParams("a+b+c", []string{"a", "b"})
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	uerr, ok := err.(*UndefinedVariableError)
+	if !ok {
+		t.Fatalf("got %T, want *UndefinedVariableError", err)
+	}
+	if uerr.Name != "c" {
+		t.Errorf("UndefinedVariableError.Name = %q, want %q", uerr.Name, "c")
+	}
+}
+
+// TestEvalSliceBeyondEightParams checks that EvalSlice, not just Eval, can
+// actually invoke code compiled with more than 8 parameters -- exercising
+// the amd64/arm64 "9th+ parameter arrives on the caller's stack" codegen
+// path end to end.
+func TestEvalSliceBeyondEightParams(t *testing.T) {
+	params := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	code, err := CompileWithParams("a+b+c+d+e+f+g+h+i+j", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+
+	args := make([]float64, len(params))
+	want := 0.0
+	for i := range args {
+		args[i] = float64(i + 1)
+		want += args[i]
+	}
+	if got := code.EvalSlice(args); got != want {
+		t.Errorf("EvalSlice(%v) = %v, want %v", args, got, want)
+	}
+}
+
+// TestEvalSliceMatchesEvalWithinEightParams checks that EvalSlice agrees
+// with Eval for parameter lists that fit in Eval's fixed-arity cases, i.e.
+// EvalSlice's <=8 path is just delegating, not reimplementing, Eval.
+func TestEvalSliceMatchesEvalWithinEightParams(t *testing.T) {
+	code, err := Compile("x*2+y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer code.Free()
+
+	if got, want := code.EvalSlice([]float64{3, 4}), code.Eval(3, 4); got != want {
+		t.Errorf("EvalSlice = %v, want %v (Eval)", got, want)
+	}
+}
@@ -0,0 +1,426 @@
+package jit
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// ParseError reports a syntax error at a byte offset into the source
+// expression, e.g. an unexpected token or a missing closing parenthesis.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("jit: parse error at byte %d: %s", e.Pos, e.Msg)
+}
+
+// Parse parses an arithmetic expression string into an expr tree, e.g.:
+//
+//	(x+1) * (y-2)
+//	select(x<0, -x, x)
+//	min(x, max(y, 0))
+//
+// Supported: +, -, *, / (usual precedence, left-associative), unary -,
+// the comparisons <, <=, >, >=, ==, != (producing 0.0/1.0, lower
+// precedence than the arithmetic operators), min(a,b), max(a,b),
+// select(cond,a,b), parenthesized subexpressions, numeric literals,
+// variables, and single-argument calls to any function registered in
+// funcs (e.g. sin(x)).
+func Parse(ex string) (expr, error) {
+	p := &parser{lex: newLexer(ex)}
+	p.next()
+	e := p.parseComparison()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, &ParseError{Pos: p.tok.pos, Msg: fmt.Sprintf("unexpected %q", p.tok.text)}
+	}
+	return e, nil
+}
+
+// --- lexer -----------------------------------------------------------------
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src}
+}
+
+// next returns the next token, advancing past it. It never returns an
+// error itself; an unrecognized byte is surfaced as a single-character
+// tokOp, which the parser rejects as "unexpected" wherever it's found.
+func (l *lexer) next() token {
+	for l.pos < len(l.src) && l.src[l.pos] == ' ' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}
+	case c == ',':
+		l.pos++
+		return token{kind: tokComma, text: ",", pos: start}
+	case c == '<' || c == '>' || c == '=' || c == '!':
+		l.pos++
+		if l.pos < len(l.src) && l.src[l.pos] == '=' {
+			l.pos++
+		}
+		return token{kind: tokOp, text: l.src[start:l.pos], pos: start}
+	case c == '+' || c == '-' || c == '*' || c == '/':
+		l.pos++
+		return token{kind: tokOp, text: string(c), pos: start}
+	case unicode.IsDigit(rune(c)) || c == '.':
+		l.pos++
+		for l.pos < len(l.src) && (unicode.IsDigit(rune(l.src[l.pos])) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}
+	case unicode.IsLetter(rune(c)) || c == '_':
+		l.pos++
+		for l.pos < len(l.src) && (unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos])) || l.src[l.pos] == '_') {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}
+	default:
+		l.pos++
+		return token{kind: tokOp, text: string(c), pos: start}
+	}
+}
+
+// --- recursive-descent parser ------------------------------------------------
+//
+// Grammar, lowest to highest precedence:
+// 	comparison := additive (("<"|"<="|">"|">="|"=="|"!=") additive)?
+// 	additive   := term (("+"|"-") term)*
+// 	term       := unary (("*"|"/") unary)*
+// 	unary      := "-" unary | primary
+// 	primary    := number | ident | ident "(" args ")" | "(" comparison ")"
+
+type parser struct {
+	lex *lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+// expect consumes the current token if it matches kind (and text, when
+// non-empty), or records a *ParseError.
+func (p *parser) expect(kind tokKind, text string) {
+	if p.err != nil {
+		return
+	}
+	if p.tok.kind != kind || (text != "" && p.tok.text != text) {
+		want := text
+		if want == "" {
+			want = "end of expression"
+		}
+		p.err = &ParseError{Pos: p.tok.pos, Msg: fmt.Sprintf("expected %q, got %q", want, p.tok.text)}
+		return
+	}
+	p.next()
+}
+
+func isComparisonOp(s string) bool {
+	switch s {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseComparison() expr {
+	x := p.parseAdditive()
+	if p.err != nil || p.tok.kind != tokOp || !isComparisonOp(p.tok.text) {
+		return x
+	}
+	op := p.tok.text
+	p.next()
+	y := p.parseAdditive()
+	return binexpr{op: op, x: x, y: y}
+}
+
+func (p *parser) parseAdditive() expr {
+	x := p.parseTerm()
+	for p.err == nil && p.tok.kind == tokOp && (p.tok.text == "+" || p.tok.text == "-") {
+		op := p.tok.text
+		p.next()
+		y := p.parseTerm()
+		x = binexpr{op: op, x: x, y: y}
+	}
+	return x
+}
+
+func (p *parser) parseTerm() expr {
+	x := p.parseUnary()
+	for p.err == nil && p.tok.kind == tokOp && (p.tok.text == "*" || p.tok.text == "/") {
+		op := p.tok.text
+		p.next()
+		y := p.parseUnary()
+		x = binexpr{op: op, x: x, y: y}
+	}
+	return x
+}
+
+func (p *parser) parseUnary() expr {
+	if p.tok.kind == tokOp && p.tok.text == "-" {
+		p.next()
+		x := p.parseUnary()
+		return binexpr{op: "-", x: constant{value: 0}, y: x}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() expr {
+	switch {
+	case p.err != nil:
+		return nil
+
+	case p.tok.kind == tokNumber:
+		text := p.tok.text
+		pos := p.tok.pos
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.err = &ParseError{Pos: pos, Msg: "invalid number: " + text}
+			return nil
+		}
+		p.next()
+		return constant{value: v}
+
+	case p.tok.kind == tokLParen:
+		p.next()
+		x := p.parseComparison()
+		p.expect(tokRParen, ")")
+		return x
+
+	case p.tok.kind == tokIdent:
+		name := p.tok.text
+		p.next()
+		if p.tok.kind != tokLParen {
+			return variable{name: name}
+		}
+		return p.parseCall(name)
+
+	default:
+		p.err = &ParseError{Pos: p.tok.pos, Msg: fmt.Sprintf("unexpected %q", p.tok.text)}
+		return nil
+	}
+}
+
+// parseCall parses the argument list of a call to name, already
+// positioned just after its opening "(". min and max take two
+// comparison-level arguments, select takes three, and everything else
+// (a host function registered in funcs) takes exactly one.
+func (p *parser) parseCall(name string) expr {
+	p.next() // consume "("
+
+	switch name {
+	case "min", "max":
+		a := p.parseComparison()
+		p.expect(tokComma, ",")
+		b := p.parseComparison()
+		p.expect(tokRParen, ")")
+		if p.err != nil {
+			return nil
+		}
+		return binexpr{op: name, x: a, y: b}
+
+	case "select":
+		cond := p.parseComparison()
+		p.expect(tokComma, ",")
+		a := p.parseComparison()
+		p.expect(tokComma, ",")
+		b := p.parseComparison()
+		p.expect(tokRParen, ")")
+		if p.err != nil {
+			return nil
+		}
+		return selectexpr{cond: cond, a: a, b: b}
+
+	default:
+		arg := p.parseComparison()
+		p.expect(tokRParen, ")")
+		if p.err != nil {
+			return nil
+		}
+		return callexpr{fun: name, arg: arg}
+	}
+}
+
+// --- tree rewrites consumed by compileParams --------------------------------
+
+// FoldConst recursively evaluates constant subexpressions (including the
+// condition of a select, which collapses entirely to whichever branch it
+// picks), returning an equivalent tree with no foldable binexpr/selectexpr
+// left.
+func FoldConst(root expr) expr {
+	switch e := root.(type) {
+	case binexpr:
+		x := FoldConst(e.x)
+		y := FoldConst(e.y)
+		cx, okx := x.(constant)
+		cy, oky := y.(constant)
+		if okx && oky {
+			return constant{value: evalConstBinOp(e.op, cx.value, cy.value)}
+		}
+		return binexpr{op: e.op, x: x, y: y}
+	case callexpr:
+		return callexpr{fun: e.fun, arg: FoldConst(e.arg)}
+	case selectexpr:
+		cond := FoldConst(e.cond)
+		a := FoldConst(e.a)
+		b := FoldConst(e.b)
+		if c, ok := cond.(constant); ok {
+			if c.value != 0 {
+				return a
+			}
+			return b
+		}
+		return selectexpr{cond: cond, a: a, b: b}
+	default:
+		return root
+	}
+}
+
+func evalConstBinOp(op string, x, y float64) float64 {
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "min":
+		if x < y {
+			return x
+		}
+		return y
+	case "max":
+		if x > y {
+			return x
+		}
+		return y
+	case "<":
+		return boolFloat(x < y)
+	case "<=":
+		return boolFloat(x <= y)
+	case ">":
+		return boolFloat(x > y)
+	case ">=":
+		return boolFloat(x >= y)
+	case "==":
+		return boolFloat(x == y)
+	case "!=":
+		return boolFloat(x != y)
+	default:
+		panic("FoldConst: unknown operator " + op)
+	}
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// recordCalls fills out[e] = true for every subexpression of root
+// (including root itself) that contains a callexpr, used by compileBinexpr
+// to avoid evaluating a call-containing branch across a register stash.
+func recordCalls(root expr, out map[expr]bool) bool {
+	switch e := root.(type) {
+	case constant, variable:
+		out[root] = false
+		return false
+	case binexpr:
+		hx := recordCalls(e.x, out)
+		hy := recordCalls(e.y, out)
+		h := hx || hy
+		out[root] = h
+		return h
+	case callexpr:
+		recordCalls(e.arg, out)
+		out[root] = true
+		return true
+	case selectexpr:
+		hc := recordCalls(e.cond, out)
+		ha := recordCalls(e.a, out)
+		hb := recordCalls(e.b, out)
+		h := hc || ha || hb
+		out[root] = h
+		return h
+	default:
+		panic(fmt.Sprintf("recordCalls: %T", root))
+	}
+}
+
+// recordDepth fills out[e] with the number of nested call expressions in
+// e's subtree, used by compileBinexpr to prefer compiling the
+// call-heavier branch first (so its result doesn't need to survive a
+// stash across the other branch's own calls).
+func recordDepth(root expr, out map[expr]int) int {
+	switch e := root.(type) {
+	case constant, variable:
+		out[root] = 0
+		return 0
+	case binexpr:
+		d := max2(recordDepth(e.x, out), recordDepth(e.y, out))
+		out[root] = d
+		return d
+	case callexpr:
+		d := recordDepth(e.arg, out) + 1
+		out[root] = d
+		return d
+	case selectexpr:
+		d := max2(max2(recordDepth(e.cond, out), recordDepth(e.a, out)), recordDepth(e.b, out))
+		out[root] = d
+		return d
+	default:
+		panic(fmt.Sprintf("recordDepth: %T", root))
+	}
+}
+
+func max2(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
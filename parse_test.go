@@ -0,0 +1,62 @@
+package jit
+
+import "testing"
+
+// TestCompileComparisonsMinMaxSelect exercises the new syntax end to end,
+// through the public string-based Compile/Eval API: select, min, max and
+// every comparison operator must actually be reachable from Parse, not
+// just from hand-built expr trees.
+func TestCompileComparisonsMinMaxSelect(t *testing.T) {
+	cases := []struct {
+		expr       string
+		x, y, want float64
+	}{
+		{"select(x<y, x, y)", 3, 5, 3},
+		{"select(x<y, x, y)", 5, 3, 3},
+		{"min(x, y)", 3, 5, 3},
+		{"max(x, y)", 3, 5, 5},
+		{"x<=y", 3, 3, 1},
+		{"x>=y", 3, 4, 0},
+		{"x==y", 2, 2, 1},
+		{"x!=y", 2, 2, 0},
+		{"x>y", 5, 3, 1},
+	}
+	for _, c := range cases {
+		code, err := Compile(c.expr)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", c.expr, err)
+		}
+		defer code.Free()
+		if got := code.Eval(c.x, c.y); got != c.want {
+			t.Errorf("Eval(%q, %v, %v) = %v, want %v", c.expr, c.x, c.y, got, c.want)
+		}
+	}
+}
+
+// TestParseError checks that malformed input is reported as a *ParseError
+// rather than panicking.
+func TestParseError(t *testing.T) {
+	for _, ex := range []string{"(x+1", "x +", "select(x<0, x)", ""} {
+		_, err := Parse(ex)
+		if err == nil {
+			t.Errorf("Parse(%q): expected an error, got nil", ex)
+			continue
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("Parse(%q): got %T, want *ParseError", ex, err)
+		}
+	}
+}
+
+// TestFoldConstSelect checks that FoldConst collapses a select with a
+// constant condition down to whichever branch it statically picks.
+func TestFoldConstSelect(t *testing.T) {
+	root, err := Parse("select(1<2, x, x+1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folded := FoldConst(root)
+	if _, ok := folded.(variable); !ok {
+		t.Errorf("FoldConst(select(true,...)) = %#v, want the then-branch (variable x)", folded)
+	}
+}
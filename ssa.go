@@ -0,0 +1,263 @@
+package jit
+
+import "fmt"
+
+// ssaOp enumerates the 3-address operations produced by lower.
+type ssaOp int
+
+const (
+	ssaConst ssaOp = iota
+	ssaArg
+	ssaAdd
+	ssaSub
+	ssaMul
+	ssaDiv
+	ssaCall
+	ssaLt
+	ssaLe
+	ssaGt
+	ssaGe
+	ssaEq
+	ssaNe
+	ssaMin
+	ssaMax
+	ssaSelect
+)
+
+// ssaInstr is a single 3-address instruction: vN = op(a, b) for most ops, or
+// vN = select(a, b, t) for ssaSelect. a, b and t are indices into the
+// enclosing instruction list identifying operand values (-1 when unused).
+// The instruction's own result is implicitly value number i, its index in
+// that list.
+type ssaInstr struct {
+	op    ssaOp
+	a, b  int     // operand value ids, -1 if unused
+	t     int     // else-branch operand id for ssaSelect, -1 otherwise
+	c     float64 // constant value, for ssaConst
+	name  string  // variable name (ssaArg) or function name (ssaCall)
+
+	start, end int // live range: defining instruction, index of last use
+}
+
+// lower flattens an expression tree into a linear list of 3-address SSA
+// instructions in evaluation order, eliminating common subexpressions by
+// hash-consing on (op, operand ids, constant/name): re-evaluating the same
+// subterm (e.g. the two occurrences of x+1 in (x+1)*(x+1)) returns the
+// existing value instead of emitting a duplicate instruction. It returns the
+// instructions together with the value id of the root.
+func lower(root expr) ([]ssaInstr, int) {
+	var instrs []ssaInstr
+	seen := make(map[string]int)
+
+	def := func(key string, in ssaInstr) int {
+		if v, ok := seen[key]; ok {
+			return v
+		}
+		instrs = append(instrs, in)
+		v := len(instrs) - 1
+		seen[key] = v
+		return v
+	}
+
+	var walk func(e expr) int
+	walk = func(e expr) int {
+		switch e := e.(type) {
+		case constant:
+			return def(fmt.Sprintf("c:%v", e.value), ssaInstr{op: ssaConst, a: -1, b: -1, t: -1, c: e.value})
+		case variable:
+			return def("a:"+e.name, ssaInstr{op: ssaArg, a: -1, b: -1, t: -1, name: e.name})
+		case binexpr:
+			a := walk(e.x)
+			b := walk(e.y)
+			op := ssaBinOp(e.op)
+			return def(fmt.Sprintf("%d:%d:%d", op, a, b), ssaInstr{op: op, a: a, b: b, t: -1})
+		case callexpr:
+			a := walk(e.arg)
+			return def(fmt.Sprintf("f:%s:%d", e.fun, a), ssaInstr{op: ssaCall, a: a, b: -1, t: -1, name: e.fun})
+		case selectexpr:
+			cond := walk(e.cond)
+			a := walk(e.a)
+			b := walk(e.b)
+			return def(fmt.Sprintf("sel:%d:%d:%d", cond, a, b), ssaInstr{op: ssaSelect, a: cond, b: a, t: b})
+		default:
+			panic(fmt.Sprintf("lower: %T", e))
+		}
+	}
+
+	rootVal := walk(root)
+	computeLiveRanges(instrs)
+	return instrs, rootVal
+}
+
+// selectexpr is the ternary select(cond, a, b) expression: it evaluates to a
+// when cond is truthy (non-zero), b otherwise. Like binexpr/callexpr, it is
+// produced by Parse and consumed here and by FoldConst.
+type selectexpr struct {
+	cond, a, b expr
+}
+
+func (selectexpr) exprNode() {}
+
+// ssaBinOp maps a parsed binary operator to its SSA opcode.
+func ssaBinOp(op string) ssaOp {
+	switch op {
+	case "+":
+		return ssaAdd
+	case "-":
+		return ssaSub
+	case "*":
+		return ssaMul
+	case "/":
+		return ssaDiv
+	case "<":
+		return ssaLt
+	case "<=":
+		return ssaLe
+	case ">":
+		return ssaGt
+	case ">=":
+		return ssaGe
+	case "==":
+		return ssaEq
+	case "!=":
+		return ssaNe
+	case "min":
+		return ssaMin
+	case "max":
+		return ssaMax
+	default:
+		panic(op)
+	}
+}
+
+// computeLiveRanges fills in start/end for every instruction: start is
+// where the value is defined, end is the index of its last use (or its own
+// definition, if it is never used again — e.g. the root).
+func computeLiveRanges(instrs []ssaInstr) {
+	for i := range instrs {
+		instrs[i].start = i
+		instrs[i].end = i
+	}
+	for i, in := range instrs {
+		if in.a >= 0 && instrs[in.a].end < i {
+			instrs[in.a].end = i
+		}
+		if in.b >= 0 && instrs[in.b].end < i {
+			instrs[in.b].end = i
+		}
+		if in.t >= 0 && instrs[in.t].end < i {
+			instrs[in.t].end = i
+		}
+	}
+}
+
+// ssaAlloc is the home linear-scan assigned to one SSA value: either a
+// register (reg >= 0) or a stack slot (reg == -1, slot counts up from 0).
+type ssaAlloc struct {
+	reg  int
+	slot int
+}
+
+// linearScan runs classic linear-scan register allocation (Poletto &
+// Sarkar) over instrs, assigning each value a register numbered
+// regBase..regBase+numRegs-1, or a stack slot when registers run out.
+// Values whose live range spans a call instruction are never given a
+// register, since a host function call clobbers every caller-saved xmm/d
+// register.
+func linearScan(instrs []ssaInstr, regBase, numRegs int) []ssaAlloc {
+	alloc := make([]ssaAlloc, len(instrs))
+	crossesCall := markCallCrossing(instrs)
+
+	free := make([]int, numRegs)
+	for i := range free {
+		free[i] = regBase + numRegs - 1 - i // pop from the end; order is arbitrary
+	}
+	var active []int // values currently holding a register, in no particular order
+	nextSlot := 0
+
+	spill := func(v int) {
+		alloc[v].reg = -1
+		alloc[v].slot = nextSlot
+		nextSlot++
+	}
+
+	for i, in := range instrs {
+		// Expire registers whose interval ended before this instruction.
+		kept := active[:0]
+		for _, v := range active {
+			if instrs[v].end >= i {
+				kept = append(kept, v)
+			} else {
+				free = append(free, alloc[v].reg)
+			}
+		}
+		active = kept
+
+		if crossesCall[i] {
+			spill(i)
+			continue
+		}
+
+		if len(free) > 0 {
+			reg := free[len(free)-1]
+			free = free[:len(free)-1]
+			alloc[i] = ssaAlloc{reg: reg}
+			active = append(active, i)
+			continue
+		}
+
+		// No free register: evict whichever active interval ends farthest
+		// in the future, unless the current value itself ends first — in
+		// which case it is the one that gets the stack slot.
+		worst := -1
+		for _, v := range active {
+			if worst == -1 || instrs[v].end > instrs[worst].end {
+				worst = v
+			}
+		}
+		if worst != -1 && instrs[worst].end > in.end {
+			reg := alloc[worst].reg
+			for k, v := range active {
+				if v == worst {
+					active = append(active[:k], active[k+1:]...)
+					break
+				}
+			}
+			spill(worst)
+			alloc[i] = ssaAlloc{reg: reg}
+			active = append(active, i)
+		} else {
+			spill(i)
+		}
+	}
+
+	return alloc
+}
+
+// markCallCrossing reports, for each SSA value, whether its live range
+// spans a ssaCall instruction.
+func markCallCrossing(instrs []ssaInstr) []bool {
+	crosses := make([]bool, len(instrs))
+	for i, in := range instrs {
+		if in.op != ssaCall {
+			continue
+		}
+		for v := range instrs {
+			if instrs[v].start < i && instrs[v].end > i {
+				crosses[v] = true
+			}
+		}
+	}
+	return crosses
+}
+
+// numSpillSlots returns how many stack slots an allocation uses.
+func numSpillSlots(alloc []ssaAlloc) int {
+	n := 0
+	for _, a := range alloc {
+		if a.reg < 0 && a.slot+1 > n {
+			n = a.slot + 1
+		}
+	}
+	return n
+}
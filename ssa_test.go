@@ -0,0 +1,79 @@
+package jit
+
+import "testing"
+
+// TestLowerCSE checks that lower hash-conses identical subexpressions:
+// "(x+1)*(x+1)" should only compute x+1 once.
+func TestLowerCSE(t *testing.T) {
+	xPlus1 := binexpr{op: "+", x: variable{name: "x"}, y: constant{value: 1}}
+	root := binexpr{op: "*", x: xPlus1, y: xPlus1}
+
+	instrs, rootVal := lower(root)
+
+	var adds int
+	for _, in := range instrs {
+		if in.op == ssaAdd {
+			adds++
+		}
+	}
+	if adds != 1 {
+		t.Errorf("got %d ssaAdd instructions, want 1 (x+1 should be shared)", adds)
+	}
+	if instrs[rootVal].op != ssaMul {
+		t.Errorf("root instruction is %v, want ssaMul", instrs[rootVal].op)
+	}
+
+	// The multiplication's two operands must refer to the very same
+	// value id, not two separately-lowered copies.
+	mul := instrs[rootVal]
+	if mul.a != mul.b {
+		t.Errorf("mul operands are %d and %d, want the same shared value", mul.a, mul.b)
+	}
+}
+
+// TestLinearScanNoSpillWithinBudget checks that an expression whose live
+// values never exceed the register window allocates entirely in
+// registers, with zero stack spills.
+func TestLinearScanNoSpillWithinBudget(t *testing.T) {
+	// x+1, reused 3 times: at most 3 values hold a register at once (x, 1
+	// and x+1 while x+1 is computed; x+1, the running product and the
+	// result at the end), well within amd64NumRegs.
+	xPlus1 := binexpr{op: "+", x: variable{name: "x"}, y: constant{value: 1}}
+	root := binexpr{op: "*", x: binexpr{op: "*", x: xPlus1, y: xPlus1}, y: xPlus1}
+
+	instrs, _ := lower(root)
+	alloc := linearScan(instrs, amd64RegBase, amd64NumRegs)
+
+	if n := numSpillSlots(alloc); n != 0 {
+		t.Errorf("numSpillSlots = %d, want 0", n)
+	}
+}
+
+// TestLinearScanSpillsUnderPressure checks that once more values are
+// simultaneously live than there are registers, linearScan spills instead
+// of silently overflowing the register window.
+func TestLinearScanSpillsUnderPressure(t *testing.T) {
+	// Build numRegs+2 independent, non-foldable leaves that are all
+	// still live when finally summed together at the end.
+	const numRegs = 2
+	var leaves []expr
+	for i := 0; i < numRegs+2; i++ {
+		leaves = append(leaves, variable{name: string(rune('a' + i))})
+	}
+	sum := leaves[0]
+	for _, l := range leaves[1:] {
+		sum = binexpr{op: "+", x: sum, y: l}
+	}
+	// Re-reference every leaf once more at the very end, so each one's
+	// live range extends from its first use all the way to here.
+	for _, l := range leaves {
+		sum = binexpr{op: "+", x: sum, y: l}
+	}
+
+	instrs, _ := lower(sum)
+	alloc := linearScan(instrs, amd64RegBase, numRegs)
+
+	if n := numSpillSlots(alloc); n == 0 {
+		t.Errorf("numSpillSlots = 0, want at least one spill with only %d registers available", numRegs)
+	}
+}
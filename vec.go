@@ -0,0 +1,446 @@
+package jit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// ymm register window available to the vectorized backend's linear-scan
+// allocator, mirroring amd64RegBase/amd64NumRegs for the scalar backend.
+const (
+	vecRegBase = 2
+	vecNumRegs = 6
+)
+
+// VecCode is code generated by CompileVec for evaluating an expression over
+// 4 doubles at a time using AVX. Expressions containing a function call
+// (callexpr) cannot be vectorized, since funcs only know how to operate on
+// a single float64 at a time; EvalSlice falls back to the scalar compiler
+// for those, lane by lane. Like Code, it must be freed with Free once no
+// longer needed.
+type VecCode struct {
+	fn   *Code // 4-lane AVX function: fn(x, y, out *float64); nil if not vectorizable
+	tail *Code // scalar fallback, used for the remainder and for calls
+}
+
+// Free releases the executable mapping(s) backing c -- fn's, if c was
+// vectorized, and tail's always. c must not be used again afterwards.
+func (c *VecCode) Free() error {
+	if c.fn != nil {
+		if err := c.fn.Free(); err != nil {
+			return err
+		}
+	}
+	return c.tail.Free()
+}
+
+// CompileVec compiles expr for batched evaluation via EvalSlice. The
+// generated function takes pointers to 4 consecutive x's, y's and out's --
+// no length, unlike the System V (x, y, out, len in rdi/rsi/rdx/rcx)
+// convention one might otherwise reach for: it is entered the same way
+// Code.Eval enters scalar code, as a Go func value cast straight onto the
+// compiled bytes (see evalVec), so its arguments actually arrive in rax,
+// rbx, rcx -- the integer/pointer argument registers of Go's internal
+// register ABI -- and EvalSlice already does the striding by 4, so the
+// generated function only ever needs to handle exactly one batch. Because
+// rax/rbx/rcx hold those three pointers for the function's entire body
+// rather than just its preamble, constants can't be staged through rax
+// the way the scalar backend does (see mov_float_r11): doing so would
+// clobber the x pointer before it's loaded, for any expression whose
+// lowering reaches a constant before it reaches x. It computes all 4
+// lanes at once with AVX (ymm0/ymm1 scratch, ymm2..ymm7 via the same SSA
+// lowering and linear-scan allocator used by the scalar amd64 backend).
+func CompileVec(ex string) (*VecCode, error) {
+	scalar, err := Compile(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := Parse(ex)
+	if err != nil {
+		return nil, err
+	}
+	if useConstFolding {
+		root = FoldConst(root)
+	}
+
+	hasCall := make(map[expr]bool)
+	recordCalls(root, hasCall)
+	if hasCall[root] {
+		// Nothing to vectorize: fall back to evaluating every lane with
+		// the scalar compiler.
+		return &VecCode{tail: scalar}, nil
+	}
+
+	instrs, rootVal := lower(root)
+	alloc := linearScan(instrs, vecRegBase, vecNumRegs)
+
+	b := vbuf{}
+	b.emit(push_rbp, mov_rsp_rbp) // function preamble
+	if err := b.compileVecSSA(instrs, alloc); err != nil {
+		// CSE can keep several independent subterms live at once with no
+		// call anywhere in sight (e.g. several products summed late), so
+		// register pressure can still exceed ymm2-ymm7. That's not a bug
+		// in the expression, just one this backend can't vectorize: fall
+		// back to scalar, same as the hasCall[root] case above.
+		return &VecCode{tail: scalar}, nil
+	}
+	if err := b.loadVecValue(rootVal, alloc, 0); err != nil {
+		return &VecCode{tail: scalar}, nil
+	}
+	b.emit(vmovupd_ymm_rcx(0)) // out[0:4] = ymm0
+	b.emit(pop_rbp, ret)       // return from function
+
+	instr, err := MakeExecutable(b.Bytes())
+	if err != nil {
+		scalar.Free()
+		return nil, err
+	}
+	return &VecCode{fn: &Code{instr}, tail: scalar}, nil
+}
+
+// EvalSlice evaluates the compiled expression for every i, writing
+// out[i] = f(xs[i], ys[i]). xs, ys and out must have equal length.
+// Inputs are processed 4 at a time via AVX; any remaining 0-3 elements (or
+// the entire slice, if expr contains a function call) are evaluated one at
+// a time with the scalar fallback.
+func (c *VecCode) EvalSlice(xs, ys, out []float64) {
+	n := len(out)
+	i := 0
+	if c.fn != nil {
+		for ; i+4 <= n; i += 4 {
+			c.fn.evalVec(&xs[i], &ys[i], &out[i])
+		}
+	}
+	for ; i < n; i++ {
+		out[i] = c.tail.Eval(xs[i], ys[i])
+	}
+}
+
+// evalVec invokes code compiled by CompileVec, whose calling convention is
+// three pointers (x, y, out) rather than Eval's two float64 arguments.
+func (c *Code) evalVec(x, y, out *float64) {
+	f := *(*func(x, y, out *float64))(unsafe.Pointer(c))
+	f(x, y, out)
+}
+
+// vbuf accumulates AVX machine code for a single CompileVec'd function.
+type vbuf struct {
+	buf
+}
+
+// compileVecSSA emits code for instrs in order, consulting alloc for where
+// each value's operands live. It mirrors buf.compileSSA, but every op
+// works on 4 packed doubles (ymm) instead of one (xmm). It reports
+// errVecSpill if alloc ever placed a value on the stack: the vectorized
+// backend has no vector-width spill path, so CompileVec must fall back to
+// scalar evaluation instead.
+func (b *vbuf) compileVecSSA(instrs []ssaInstr, alloc []ssaAlloc) error {
+	for i, in := range instrs {
+		switch in.op {
+		case ssaConst:
+			b.emit(mov_float_r11(in.c), mov_r11_xmm0, vbroadcastsd_xmm0_ymm(0))
+		case ssaArg:
+			b.compileVecVariable(in.name)
+		case ssaCall:
+			panic("compileVecSSA: unexpected call, should have been caught by CompileVec")
+		case ssaLt, ssaLe, ssaGt, ssaGe, ssaEq, ssaNe:
+			if err := b.compileVecCompare(in, alloc); err != nil {
+				return err
+			}
+		case ssaSelect:
+			if err := b.compileVecSelect(in, alloc); err != nil {
+				return err
+			}
+		default:
+			if err := b.loadVecValue(in.b, alloc, 1); err != nil {
+				return err
+			}
+			if err := b.loadVecValue(in.a, alloc, 0); err != nil {
+				return err
+			}
+			b.emit(vecBinOpcode(in.op))
+		}
+		if err := b.storeVecValue(i, alloc, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errVecSpill reports that an expression's live values don't all fit in
+// ymm2-ymm7 at once. CompileVec treats it as "not vectorizable" rather
+// than a hard error, the same way it treats hasCall[root].
+var errVecSpill = fmt.Errorf("jit: CompileVec: expression needs more live registers than ymm2-ymm7 provides")
+
+func (b *vbuf) compileVecVariable(name string) {
+	switch name {
+	default:
+		panic("undefined variable:" + name)
+	case "x":
+		b.emit(vmovupd_rax_ymm(0))
+	case "y":
+		b.emit(vmovupd_rbx_ymm(0))
+	}
+}
+
+// loadVecValue emits code to move SSA value v's home register into ymm
+// register dst. Unlike the scalar backend, the vectorized backend has
+// nowhere to spill a ymm register to (there is no packed-stack-slot
+// layout here), so a value that linearScan couldn't fit in ymm2-ymm7
+// surfaces as errVecSpill instead of emitting bogus code.
+func (b *vbuf) loadVecValue(v int, alloc []ssaAlloc, dst int) error {
+	a := alloc[v]
+	if a.reg < 0 {
+		return errVecSpill
+	}
+	if a.reg != dst {
+		b.emit(vmov_ymm(a.reg, dst))
+	}
+	return nil
+}
+
+func (b *vbuf) storeVecValue(v int, alloc []ssaAlloc, src int) error {
+	a := alloc[v]
+	if a.reg < 0 {
+		return errVecSpill
+	}
+	if a.reg != src {
+		b.emit(vmov_ymm(src, a.reg))
+	}
+	return nil
+}
+
+func vecBinOpcode(op ssaOp) []byte {
+	switch op {
+	case ssaAdd:
+		return vaddpd_ymm1_ymm0
+	case ssaSub:
+		return vsubpd_ymm1_ymm0
+	case ssaMul:
+		return vmulpd_ymm1_ymm0
+	case ssaDiv:
+		return vdivpd_ymm1_ymm0
+	case ssaMin:
+		return vminpd_ymm1_ymm0
+	case ssaMax:
+		return vmaxpd_ymm1_ymm0
+	default:
+		panic(fmt.Sprint("vecBinOpcode: ", op))
+	}
+}
+
+// compileVecCompare is the AVX counterpart of buf.compileCompare: it
+// produces a 0.0/1.0 result per lane via vcmppd+vandpd against a broadcast
+// 1.0, folding GT/GE into swapped-operand LT/LE the same way.
+func (b *vbuf) compileVecCompare(in ssaInstr, alloc []ssaAlloc) error {
+	lhs, rhs := in.a, in.b
+	if in.op == ssaGt || in.op == ssaGe {
+		lhs, rhs = rhs, lhs
+	}
+	if err := b.loadVecValue(rhs, alloc, 1); err != nil {
+		return err
+	}
+	if err := b.loadVecValue(lhs, alloc, 0); err != nil {
+		return err
+	}
+	b.emit(vcmppd_ymm1_ymm0(cmpPredicate(in.op)))
+	// The mask just landed in ymm0; materialize 1.0 via xmm1/ymm1 instead
+	// of the usual xmm0 scratch, since mov_r11_xmm0 is a legacy (non-VEX)
+	// move that overwrites ymm0's low 128 bits (the value in lane 0, zero
+	// in lane 1), not the full register -- reusing ymm0 here would
+	// silently corrupt lanes 0 and 1 of the mask it's about to be ANDed
+	// against.
+	b.emit(mov_float_r11(1.0), mov_r11_xmm1, vbroadcastsd_xmm1_ymm(1), vandpd_ymm1_ymm0)
+	return nil
+}
+
+// compileVecSelect is the AVX counterpart of buf.compileSelect: the same
+// branchless cond*a + (1-cond)*b lowering, using ymm8/ymm9 as scratch since
+// they fall outside the linear-scan allocator's ymm2..ymm7 window.
+func (b *vbuf) compileVecSelect(in ssaInstr, alloc []ssaAlloc) error {
+	if err := b.loadVecValue(in.a, alloc, 0); err != nil { // ymm0 = cond
+		return err
+	}
+	b.emit(vmov_ymm(0, 8))                                 // ymm8 = cond
+	if err := b.loadVecValue(in.b, alloc, 1); err != nil { // ymm1 = thenVal
+		return err
+	}
+	b.emit(vmulpd_ymm0_ymm1)                               // ymm1 = cond * thenVal
+	b.emit(vmov_ymm(1, 9))                                 // ymm9 = cond * thenVal
+	if err := b.loadVecValue(in.t, alloc, 1); err != nil { // ymm1 = elseVal
+		return err
+	}
+	b.emit(mov_float_r11(1.0), mov_r11_xmm0, vbroadcastsd_xmm0_ymm(0)) // ymm0 = 1.0
+	b.emit(vsubpd_ymm8_ymm0)                                           // ymm0 = 1.0 - cond
+	b.emit(vmulpd_ymm0_ymm1)                                           // ymm1 = (1-cond) * elseVal
+	b.emit(vmov_ymm(9, 0))                                             // ymm0 = cond * thenVal
+	b.emit(vaddpd_ymm1_ymm0)                                           // ymm0 += ymm1
+	return nil
+}
+
+// --- AVX instruction encoding ------------------------------------------------
+//
+// Go's assembler has no mnemonics for these, so -- just like the SSE2
+// primitives in amd64.go -- they're hand-encoded here. Every one uses the
+// 3-byte VEX prefix (0xC4) rather than the shorter 2-byte form, since the
+// 3-byte form is the only one that can address ymm8/ymm9, the scratch
+// registers compileVecSelect uses above.
+
+const (
+	vexMap0F   = 0x01 // VEX.mmmmm: implied leading 0F
+	vexMap0F38 = 0x02 // VEX.mmmmm: implied leading 0F 38
+	vexPP66    = 0x01 // VEX.pp: implied mandatory 0x66 prefix
+)
+
+// vexRR builds a 3-byte-VEX instruction of the form
+//
+//	OP dst, src1, src2
+//
+// i.e. ModRM.reg = dst, VEX.vvvv = src1, ModRM.rm = src2, all register-direct.
+// Instructions with no VEX.vvvv operand (moves, broadcasts) pass src1 = 0,
+// which VEX encodes as the conventional "unused" value of 1111.
+func vexRR(mmmmm byte, l256 bool, pp, opcode byte, dst, src1, src2 int) []byte {
+	rexR, rexB := byte(1), byte(1)
+	if dst >= 8 {
+		rexR = 0
+	}
+	if src2 >= 8 {
+		rexB = 0
+	}
+	const rexX = 1 // no SIB index register is ever used here
+	l := byte(0)
+	if l256 {
+		l = 1
+	}
+	byte1 := rexR<<7 | rexX<<6 | rexB<<5 | mmmmm
+	byte2 := (^byte(src1)&0xF)<<3 | l<<2 | pp
+	modrm := 0xC0 | byte(dst&7)<<3 | byte(src2&7)
+	return []byte{0xC4, byte1, byte2, opcode, modrm}
+}
+
+// vexMem builds a 3-byte-VEX instruction with a plain [base] memory operand
+// (mod=00, no SIB, no displacement) and no VEX.vvvv operand, used for the
+// ymm load/store primitives below.
+func vexMem(mmmmm byte, l256 bool, pp, opcode byte, reg, base int) []byte {
+	rexR, rexB := byte(1), byte(1)
+	if reg >= 8 {
+		rexR = 0
+	}
+	if base >= 8 {
+		rexB = 0
+	}
+	const rexX = 1
+	l := byte(0)
+	if l256 {
+		l = 1
+	}
+	byte1 := rexR<<7 | rexX<<6 | rexB<<5 | mmmmm
+	byte2 := byte(0xF)<<3 | l<<2 | pp
+	modrm := byte(reg&7)<<3 | byte(base&7)
+	return []byte{0xC4, byte1, byte2, opcode, modrm}
+}
+
+func ymmOp(opcode byte, dst, src1, src2 int) []byte {
+	return vexRR(vexMap0F, true, vexPP66, opcode, dst, src1, src2)
+}
+
+// vaddpd_ymm1_ymm0 computes ymm0 = ymm0 + ymm1 (VADDPD).
+var vaddpd_ymm1_ymm0 = ymmOp(0x58, 0, 0, 1)
+
+// vsubpd_ymm1_ymm0 computes ymm0 = ymm0 - ymm1 (VSUBPD).
+var vsubpd_ymm1_ymm0 = ymmOp(0x5C, 0, 0, 1)
+
+// vmulpd_ymm1_ymm0 computes ymm0 = ymm0 * ymm1 (VMULPD).
+var vmulpd_ymm1_ymm0 = ymmOp(0x59, 0, 0, 1)
+
+// vdivpd_ymm1_ymm0 computes ymm0 = ymm0 / ymm1 (VDIVPD).
+var vdivpd_ymm1_ymm0 = ymmOp(0x5E, 0, 0, 1)
+
+// vminpd_ymm1_ymm0 computes ymm0 = min(ymm0, ymm1) (VMINPD).
+var vminpd_ymm1_ymm0 = ymmOp(0x5D, 0, 0, 1)
+
+// vmaxpd_ymm1_ymm0 computes ymm0 = max(ymm0, ymm1) (VMAXPD).
+var vmaxpd_ymm1_ymm0 = ymmOp(0x5F, 0, 0, 1)
+
+// vandpd_ymm1_ymm0 computes ymm0 &= ymm1 (VANDPD), masking a vcmppd result
+// against a broadcast 1.0, same as and_xmm1_xmm0 on the scalar backend.
+var vandpd_ymm1_ymm0 = ymmOp(0x54, 0, 0, 1)
+
+// vmulpd_ymm0_ymm1 computes ymm1 = ymm1 * ymm0 (VMULPD), used by
+// compileVecSelect where the destination is ymm1 rather than ymm0.
+var vmulpd_ymm0_ymm1 = ymmOp(0x59, 1, 1, 0)
+
+// vsubpd_ymm8_ymm0 computes ymm0 = ymm0 - ymm8 (VSUBPD).
+var vsubpd_ymm8_ymm0 = ymmOp(0x5C, 0, 0, 8)
+
+// vcmppd_ymm1_ymm0 computes ymm0 = cmppd(ymm0, ymm1, predicate) (VCMPPD),
+// the AVX counterpart of cmppd_xmm1_xmm0.
+func vcmppd_ymm1_ymm0(predicate byte) []byte {
+	return append(ymmOp(0xC2, 0, 0, 1), predicate)
+}
+
+// vmov_ymm moves ymm(src) into ymm(dst) (VMOVAPD, register-to-register).
+func vmov_ymm(src, dst int) []byte {
+	return vexRR(vexMap0F, true, vexPP66, 0x28, dst, 0, src)
+}
+
+// vbroadcastsd_xmm0_ymm broadcasts the low 64 bits of xmm0 to all 4 lanes
+// of ymm(dst) (VBROADCASTSD).
+func vbroadcastsd_xmm0_ymm(dst int) []byte {
+	return vexRR(vexMap0F38, true, vexPP66, 0x19, dst, 0, 0)
+}
+
+// vbroadcastsd_xmm1_ymm broadcasts the low 64 bits of xmm1 to all 4 lanes
+// of ymm(dst) (VBROADCASTSD), for the callers that need xmm0/ymm0 left
+// alone (e.g. compileVecCompare, which still needs ymm0's cmppd result).
+func vbroadcastsd_xmm1_ymm(dst int) []byte {
+	return vexRR(vexMap0F38, true, vexPP66, 0x19, dst, 0, 1)
+}
+
+// mov_float_r11/mov_r11_xmm0/mov_r11_xmm1 are this file's counterparts to
+// amd64.go's mov_float_rax/mov_rax_xmm0/mov_rax_xmm1, staging a float64
+// immediate through r11 instead of rax. Unlike the scalar backend, rax,
+// rbx and rcx are the vectorized function's x, y and out base pointers
+// for its entire body (see compileVecVariable/CompileVec), kept live
+// across every instruction rather than just the preamble -- so any
+// constant emitted via rax would clobber whichever of them hasn't been
+// loaded into its home ymm register yet. r11 is caller-saved and
+// otherwise unused by this backend, so it's free to use as scratch.
+func mov_float_r11(v float64) []byte {
+	return movAbsR11(math.Float64bits(v))
+}
+
+func movAbsR11(bits uint64) []byte {
+	out := []byte{0x49, 0xBB, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(out[2:], bits)
+	return out
+}
+
+var (
+	mov_r11_xmm0 = []byte{0x66, 0x49, 0x0F, 0x6E, 0xC3}
+	mov_r11_xmm1 = []byte{0x66, 0x49, 0x0F, 0x6E, 0xCB}
+)
+
+// vmovupd_rax_ymm loads 4 consecutive doubles from [rax] into ymm(dst)
+// (VMOVUPD), where rax holds CompileVec's first function argument (Go's
+// internal ABI's first integer/pointer argument register).
+func vmovupd_rax_ymm(dst int) []byte {
+	return vexMem(vexMap0F, true, vexPP66, 0x10, dst, 0)
+}
+
+// vmovupd_rbx_ymm loads 4 consecutive doubles from [rbx] into ymm(dst)
+// (VMOVUPD), where rbx holds CompileVec's second function argument (Go's
+// internal ABI's second integer/pointer argument register).
+func vmovupd_rbx_ymm(dst int) []byte {
+	return vexMem(vexMap0F, true, vexPP66, 0x10, dst, 3)
+}
+
+// vmovupd_ymm_rcx stores ymm(src) to [rcx] (VMOVUPD), where rcx holds
+// CompileVec's third (output) function argument (Go's internal ABI's
+// third integer/pointer argument register).
+func vmovupd_ymm_rcx(src int) []byte {
+	return vexMem(vexMap0F, true, vexPP66, 0x11, src, 1)
+}
@@ -0,0 +1,107 @@
+package jit
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestCompileVecFallsBackUnderRegisterPressure checks that an expression
+// whose CSE'd live values exceed ymm2-ymm7 falls back to the scalar path
+// (VecCode.fn == nil) instead of panicking during codegen.
+func TestCompileVecFallsBackUnderRegisterPressure(t *testing.T) {
+	// CompileVec only has x and y to work with (it compiles its scalar
+	// fallback via Compile, which assumes defaultParams), so the pressure
+	// has to come from distinct x-plus-constant leaves rather than
+	// distinct variable names. Build vecNumRegs+2 of them (x+1..x+8),
+	// sum them left-to-right, then walk the same leaves again in a
+	// second left-to-right sum -- exactly TestLinearScanSpillsUnderPressure's
+	// technique, just expressed as a string for CompileVec/Parse to
+	// consume. The second pass re-references every leaf, so each one's
+	// live range extends from its first use all the way through the
+	// last leaf's second use, forcing more than vecNumRegs (6) values
+	// live at once.
+	const numLeaves = vecNumRegs + 2
+	var leaves []string
+	for i := 1; i <= numLeaves; i++ {
+		leaves = append(leaves, fmt.Sprintf("(x+%d)", i))
+	}
+	sum := leaves[0]
+	for _, l := range leaves[1:] {
+		sum = "(" + sum + ")+" + l
+	}
+	for _, l := range leaves {
+		sum = "(" + sum + ")+" + l
+	}
+
+	vc, err := CompileVec(sum)
+	if err != nil {
+		t.Fatalf("CompileVec: %v", err)
+	}
+	if vc.fn != nil {
+		t.Fatalf("expected CompileVec to fall back to scalar under register pressure, got a vectorized fn")
+	}
+	if vc.tail == nil {
+		t.Fatalf("CompileVec fell back but left tail nil")
+	}
+}
+
+// TestCompileVecFallsBackOnCall checks the existing, simpler
+// not-vectorizable path still works: a call anywhere in the expression
+// means fn stays nil and every element goes through tail.
+func TestCompileVecFallsBackOnCall(t *testing.T) {
+	vc, err := CompileVec("sqrt(x)+y")
+	if err != nil {
+		t.Fatalf("CompileVec: %v", err)
+	}
+	if vc.fn != nil {
+		t.Fatalf("expected no vectorized fn for an expression containing a call")
+	}
+}
+
+// TestCompileVecEvalSliceMatchesScalar runs vectorized expressions'
+// EvalSlice over more than 4 elements (exercising both the AVX fn path and
+// the scalar tail for the remainder) and checks every result against
+// Compile's scalar Eval, lane by lane. Every other vec test only inspects
+// vc.fn == nil/!= nil; none actually entered the hand-encoded VEX codegen
+// and checked what it computed.
+func TestCompileVecEvalSliceMatchesScalar(t *testing.T) {
+	for _, expr := range []string{
+		// x is this expression's first-lowered leaf (the constant in
+		// y+1 only appears later), so this alone wouldn't have caught a
+		// backend that clobbers x's base pointer with an immediate.
+		"select(x<y, x, y) + min(x, y) - max(x, y) + (x*y - x/(y+1))",
+		// Here a constant is lowered before x: max(0, x-1) computes the
+		// 0 leaf (for max's first operand) before walking into x-1.
+		"max(0, x-1)",
+		"1 + 2*x",
+	} {
+		vc, err := CompileVec(expr)
+		if err != nil {
+			t.Fatalf("CompileVec(%q): %v", expr, err)
+		}
+		if vc.fn == nil {
+			t.Fatalf("expected %q to vectorize", expr)
+		}
+		defer vc.Free()
+
+		scalar, err := Compile(expr)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", expr, err)
+		}
+		defer scalar.Free()
+
+		// 10 elements: two full 4-wide AVX batches plus a 2-element
+		// scalar tail, so both paths in EvalSlice run.
+		xs := []float64{1, 2, 3, -4, 5, 6, 7, 8, 9, -10}
+		ys := []float64{2, 2, -1, 4, 0.5, 6, -7, 1, 9, 10}
+		out := make([]float64, len(xs))
+		vc.EvalSlice(xs, ys, out)
+
+		for i := range xs {
+			want := scalar.Eval(xs[i], ys[i])
+			if out[i] != want {
+				t.Errorf("EvalSlice(%q)[%d] (x=%v, y=%v) = %v, want %v", expr, i, xs[i], ys[i], out[i], want)
+			}
+		}
+	}
+}